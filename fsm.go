@@ -0,0 +1,423 @@
+package flotilla
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	mdb "github.com/jbooth/gomdb"
+	"github.com/jbooth/raft"
+)
+
+// Result is what a Command returns, and what Command() eventually
+// delivers on its returned channel: either a Value from a successful
+// apply, or an Err.
+type Result struct {
+	Value interface{}
+	Err   error
+}
+
+// Command is a named state-machine operation: given a write transaction
+// and the raw args a caller passed to DB.Command(), it mutates the MDB
+// and returns a Result.  Registered per-name in the map NewDB is given,
+// merged over defaultCommands().
+type Command func(txn *mdb.Txn, dbi mdb.DBI, args [][]byte) Result
+
+// commandCallback is how a caller of DB.Command() (or a peer that
+// forwarded a command to us) learns its result, once the command's log
+// entry is applied -- see flotillaState.Apply.
+type commandCallback struct {
+	originAddr string
+	reqNo      uint64
+	result     chan Result
+	state      *flotillaState
+}
+
+func (cb *commandCallback) cancel() {
+	cb.state.cancelCommand(cb.reqNo)
+}
+
+// replicationSub is a proxy's subscription to the leader's applied-command
+// stream; see flotillaState.subscribe / Apply's fan-out.
+type replicationSub struct {
+	ch chan appliedEntry
+}
+
+type appliedEntry struct {
+	Index uint64
+	Bytes []byte
+}
+
+// flotillaState is the raft.FSM backing a flotilla server: it applies
+// committed commands to its local MDB, tracks the applied index for
+// LinearizableRead/WaitForIndex, resolves commandCallbacks for commands
+// this node originated, and fans applied entries out to any proxies
+// tailing this node's replication stream.
+type flotillaState struct {
+	env       *mdb.Env
+	dbi       mdb.DBI
+	commands  map[string]Command
+	localAddr string
+	lg        *log.Logger
+
+	// metrics/events instrument Apply/ApplyReplicated and let
+	// flotillaSnapshot report EventSnapshotTaken/EventLogCompaction for
+	// every snapshot raft takes, not just ones server.Snapshot() forced;
+	// both are shared with the owning *server (see NewDB/newProxyServer).
+	metrics Metrics
+	events  chan Event
+
+	mu               sync.Mutex
+	cond             *sync.Cond
+	appliedIndex     uint64
+	lastApplyLatency time.Duration
+	nextReqNo        uint64
+	pending          map[uint64]*commandCallback
+
+	subsMu sync.Mutex
+	subs   map[*replicationSub]bool
+}
+
+func newFlotillaState(mdbDir string, commands map[string]Command, localAddr string, lg *log.Logger, metrics Metrics, events chan Event) (*flotillaState, error) {
+	env, err := mdb.NewEnv()
+	if err != nil {
+		return nil, err
+	}
+	if err := env.SetMapSize(1024 * 1024 * 1024); err != nil {
+		return nil, err
+	}
+	if err := env.Open(mdbDir, 0, 0644); err != nil {
+		return nil, err
+	}
+	txn, err := env.BeginTxn(nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	dbi, err := txn.DBIOpen(nil, 0)
+	if err != nil {
+		txn.Abort()
+		return nil, err
+	}
+	if err := txn.Commit(); err != nil {
+		return nil, err
+	}
+	fs := &flotillaState{
+		env:       env,
+		dbi:       dbi,
+		commands:  commands,
+		localAddr: localAddr,
+		lg:        lg,
+		metrics:   metrics,
+		events:    events,
+		pending:   make(map[uint64]*commandCallback),
+		subs:      make(map[*replicationSub]bool),
+	}
+	fs.cond = sync.NewCond(&fs.mu)
+	return fs, nil
+}
+
+// newCommand registers a pending callback for a command this node is
+// about to run (directly, as leader) or forward to the leader, keyed by a
+// locally-unique request number so the eventual Apply() of that entry --
+// wherever it runs in the cluster -- can find its way back here.
+func (fs *flotillaState) newCommand() *commandCallback {
+	fs.mu.Lock()
+	fs.nextReqNo++
+	reqNo := fs.nextReqNo
+	cb := &commandCallback{originAddr: fs.localAddr, reqNo: reqNo, result: make(chan Result, 1), state: fs}
+	fs.pending[reqNo] = cb
+	fs.mu.Unlock()
+	return cb
+}
+
+func (fs *flotillaState) cancelCommand(reqNo uint64) {
+	fs.mu.Lock()
+	cb, ok := fs.pending[reqNo]
+	if ok {
+		delete(fs.pending, reqNo)
+	}
+	fs.mu.Unlock()
+	if ok {
+		cb.result <- Result{nil, fmt.Errorf("command %d canceled", reqNo)}
+	}
+}
+
+// Apply implements raft.FSM: it's invoked with every committed log entry,
+// on every node in the cluster, in log order.
+func (fs *flotillaState) Apply(l *raft.Log) interface{} {
+	var entry logEntry
+	if err := gob.NewDecoder(bytes.NewReader(l.Data)).Decode(&entry); err != nil {
+		fs.lg.Printf("ERROR decoding log entry at index %d : %s", l.Index, err)
+		return nil
+	}
+	start := time.Now()
+	result := fs.applyEntry(entry)
+	latency := time.Since(start)
+	fs.metrics.ObserveLatency("fsm.apply.latency", latency, entry.Cmd)
+	if result.Err != nil {
+		fs.metrics.IncCounter("fsm.apply.error", entry.Cmd)
+	} else {
+		fs.metrics.IncCounter("fsm.apply.applied", entry.Cmd)
+	}
+	fs.mu.Lock()
+	fs.appliedIndex = l.Index
+	fs.lastApplyLatency = latency
+	cb, isOurs := fs.pending[entry.ReqNo]
+	if isOurs && entry.OriginAddr == fs.localAddr {
+		delete(fs.pending, entry.ReqNo)
+	} else {
+		isOurs = false
+	}
+	fs.cond.Broadcast()
+	fs.mu.Unlock()
+	if isOurs {
+		cb.result <- result
+	}
+	fs.publish(appliedEntry{Index: l.Index, Bytes: l.Data})
+	return result
+}
+
+// applyEntry runs entry's named command inside a local write transaction,
+// used both for normal raft-applied entries and (without the raft.Log
+// wrapper) for entries replayed from a leader's replication stream.
+func (fs *flotillaState) applyEntry(entry logEntry) Result {
+	cmdFn, ok := fs.commands[entry.Cmd]
+	if !ok {
+		return Result{nil, fmt.Errorf("unknown command %s", entry.Cmd)}
+	}
+	txn, err := fs.env.BeginTxn(nil, 0)
+	if err != nil {
+		return Result{nil, err}
+	}
+	result := cmdFn(txn, fs.dbi, entry.Args)
+	if result.Err != nil {
+		txn.Abort()
+		return result
+	}
+	if err := txn.Commit(); err != nil {
+		return Result{nil, err}
+	}
+	return result
+}
+
+// ApplyReplicated applies a command a proxy received from the leader's
+// replication stream directly, bypassing raft (proxies aren't raft
+// peers).  idx is the leader's log index for this entry, so a proxy's
+// AppliedIndex()/WaitForIndex() track the same index space voters do.
+// Like Apply, it resolves the pending commandCallback of a command this
+// node forwarded to the leader.
+func (fs *flotillaState) ApplyReplicated(idx uint64, cmdBytes []byte) error {
+	var entry logEntry
+	if err := gob.NewDecoder(bytes.NewReader(cmdBytes)).Decode(&entry); err != nil {
+		return err
+	}
+	start := time.Now()
+	result := fs.applyEntry(entry)
+	latency := time.Since(start)
+	fs.metrics.ObserveLatency("fsm.apply.latency", latency, entry.Cmd)
+	if result.Err != nil {
+		fs.metrics.IncCounter("fsm.apply.error", entry.Cmd)
+	} else {
+		fs.metrics.IncCounter("fsm.apply.applied", entry.Cmd)
+	}
+	fs.mu.Lock()
+	fs.appliedIndex = idx
+	fs.lastApplyLatency = latency
+	cb, isOurs := fs.pending[entry.ReqNo]
+	if isOurs && entry.OriginAddr == fs.localAddr {
+		delete(fs.pending, entry.ReqNo)
+	} else {
+		isOurs = false
+	}
+	fs.cond.Broadcast()
+	fs.mu.Unlock()
+	if isOurs {
+		cb.result <- result
+	}
+	return nil
+}
+
+// AppliedIndex returns the highest log index this node's FSM has applied.
+func (fs *flotillaState) AppliedIndex() uint64 {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.appliedIndex
+}
+
+// LastApplyLatency returns how long the most recently applied command took
+// to run against the local MDB, backing Stats()'s per-command apply
+// latency field.
+func (fs *flotillaState) LastApplyLatency() time.Duration {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.lastApplyLatency
+}
+
+// emit publishes evt on events, logging and dropping it rather than
+// blocking the apply path if nobody's draining Events() -- mirrors
+// server.emit.
+func (fs *flotillaState) emit(evt Event) {
+	evt.At = time.Now()
+	select {
+	case fs.events <- evt:
+	default:
+		fs.lg.Printf("WARNING dropping event %s, Events() channel full", evt.Type)
+	}
+}
+
+// WaitForIndex blocks until AppliedIndex() reaches idx or timeout elapses,
+// backing LinearizableRead's wait for the local FSM to catch up to a
+// read index.
+func (fs *flotillaState) WaitForIndex(idx uint64, timeout time.Duration) error {
+	done := make(chan struct{})
+	timer := time.AfterFunc(timeout, func() {
+		close(done)
+		fs.mu.Lock()
+		fs.cond.Broadcast()
+		fs.mu.Unlock()
+	})
+	defer timer.Stop()
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	for fs.appliedIndex < idx {
+		select {
+		case <-done:
+			return fmt.Errorf("timed out after %s waiting for applied index %d, have %d", timeout, idx, fs.appliedIndex)
+		default:
+		}
+		fs.cond.Wait()
+	}
+	return nil
+}
+
+// ReadTxn returns a read-only MDB transaction reflecting everything
+// applied so far.
+func (fs *flotillaState) ReadTxn() (*mdb.Txn, error) {
+	return fs.env.BeginTxn(nil, mdb.RDONLY)
+}
+
+// Snapshot implements raft.FSM by handing raft a dump of the current MDB
+// contents to persist via the configured SnapshotStore; see
+// flotillaSnapshot.Persist.
+func (fs *flotillaState) Snapshot() (raft.FSMSnapshot, error) {
+	txn, err := fs.env.BeginTxn(nil, mdb.RDONLY)
+	if err != nil {
+		return nil, err
+	}
+	return &flotillaSnapshot{fs: fs, txn: txn}, nil
+}
+
+// Restore replaces this node's MDB contents with the key/value dump in r
+// (as produced by flotillaSnapshot.Persist, or a backup taken via
+// server.Snapshot/the snapshot store).  Used both by raft's own
+// snapshot-install path and directly by server.Restore().
+func (fs *flotillaState) Restore(r io.ReadCloser) error {
+	defer r.Close()
+	txn, err := fs.env.BeginTxn(nil, 0)
+	if err != nil {
+		return err
+	}
+	if err := txn.Drop(fs.dbi, 0); err != nil {
+		txn.Abort()
+		return err
+	}
+	dec := gob.NewDecoder(r)
+	for {
+		var kv [2][]byte
+		if err := dec.Decode(&kv); err != nil {
+			if err == io.EOF {
+				break
+			}
+			txn.Abort()
+			return err
+		}
+		if err := txn.Put(fs.dbi, kv[0], kv[1], 0); err != nil {
+			txn.Abort()
+			return err
+		}
+	}
+	return txn.Commit()
+}
+
+// flotillaSnapshot implements raft.FSMSnapshot: it walks the read-only
+// MDB transaction it was handed at Snapshot() time and writes every
+// key/value pair to the sink raft gives it, in the same gob-of-pairs
+// format Restore() expects.
+type flotillaSnapshot struct {
+	fs  *flotillaState
+	txn *mdb.Txn
+}
+
+func (s *flotillaSnapshot) Persist(sink raft.SnapshotSink) error {
+	// s.txn is aborted once, in Release(), which raft calls after Persist
+	// regardless of outcome.
+	enc := gob.NewEncoder(sink)
+	cursor, err := s.txn.CursorOpen(s.fs.dbi)
+	if err != nil {
+		sink.Cancel()
+		return err
+	}
+	defer cursor.Close()
+	for {
+		key, val, err := cursor.Get(nil, nil, mdb.NEXT)
+		if err != nil {
+			break // cursor exhausted
+		}
+		if err := enc.Encode([2][]byte{key, val}); err != nil {
+			sink.Cancel()
+			return err
+		}
+	}
+	if err := sink.Close(); err != nil {
+		return err
+	}
+	// Persist runs for every snapshot raft takes, whether forced by an
+	// explicit server.Snapshot() call or triggered automatically once the
+	// log grows past its size threshold -- emitting here, rather than in
+	// server.Snapshot(), is the only way Events() sees the automatic case
+	// too, which is the common one in practice.
+	s.fs.metrics.IncCounter("snapshot.taken")
+	s.fs.emit(Event{Type: EventSnapshotTaken})
+	s.fs.emit(Event{Type: EventLogCompaction})
+	return nil
+}
+
+func (s *flotillaSnapshot) Release() {
+	s.txn.Abort()
+}
+
+// subscribe registers a new replication subscriber, returning the channel
+// Apply() will publish every subsequently-applied entry to.  Callers must
+// unsubscribe when done to avoid leaking the channel.
+func (fs *flotillaState) subscribe() *replicationSub {
+	sub := &replicationSub{ch: make(chan appliedEntry, 256)}
+	fs.subsMu.Lock()
+	fs.subs[sub] = true
+	fs.subsMu.Unlock()
+	return sub
+}
+
+func (fs *flotillaState) unsubscribe(sub *replicationSub) {
+	fs.subsMu.Lock()
+	delete(fs.subs, sub)
+	fs.subsMu.Unlock()
+}
+
+// publish fans an applied entry out to every active replication
+// subscriber, dropping it for any subscriber that isn't keeping up rather
+// than blocking raft's own apply loop.
+func (fs *flotillaState) publish(entry appliedEntry) {
+	fs.subsMu.Lock()
+	defer fs.subsMu.Unlock()
+	for sub := range fs.subs {
+		select {
+		case sub.ch <- entry:
+		default:
+			fs.lg.Printf("WARNING dropping replicated entry at index %d, subscriber too far behind", entry.Index)
+		}
+	}
+}
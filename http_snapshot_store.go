@@ -0,0 +1,121 @@
+package flotilla
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/jbooth/raft"
+)
+
+// HTTPSnapshotStore writes snapshots to a local raft.FileSnapshotStore (so
+// Create/List/Open work the same as today on the node that took the
+// snapshot) but falls back to pulling from a peer's SnapshotHTTPHandler
+// when asked to Open a snapshot it doesn't have locally -- e.g. a brand
+// new node bootstrapping from a leader's snapshot over HTTP rather than
+// copying raft logs.
+type HTTPSnapshotStore struct {
+	local      raft.SnapshotStore
+	remoteBase string
+	client     *http.Client
+	lg         *log.Logger
+}
+
+// NewHTTPSnapshotStore builds an HTTPSnapshotStore rooted at dataDir,
+// retaining retain local snapshots and pulling from remoteBase (a running
+// node's SnapshotHTTPHandler, e.g. "http://10.0.0.1:7000") when a
+// requested snapshot isn't available locally.  remoteBase may be empty,
+// in which case this store behaves like a plain local file store.
+func NewHTTPSnapshotStore(dataDir string, retain int, remoteBase string, lg *log.Logger) (*HTTPSnapshotStore, error) {
+	local, err := raft.NewFileSnapshotStoreLog(dataDir, retain, lg)
+	if err != nil {
+		return nil, err
+	}
+	return &HTTPSnapshotStore{local, remoteBase, &http.Client{Timeout: 1 * time.Minute}, lg}, nil
+}
+
+func (st *HTTPSnapshotStore) Create(index, term uint64, peers []byte) (raft.SnapshotSink, error) {
+	return st.local.Create(index, term, peers)
+}
+
+func (st *HTTPSnapshotStore) List() ([]*raft.SnapshotMeta, error) {
+	metas, err := st.local.List()
+	if err != nil {
+		return nil, err
+	}
+	if len(metas) > 0 || st.remoteBase == "" {
+		return metas, nil
+	}
+	resp, err := st.client.Get(st.remoteBase + "/snapshots")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("remote %s returned %s listing snapshots", st.remoteBase, resp.Status)
+	}
+	var remote []*raft.SnapshotMeta
+	if err := json.NewDecoder(resp.Body).Decode(&remote); err != nil {
+		return nil, err
+	}
+	return remote, nil
+}
+
+func (st *HTTPSnapshotStore) Open(id string) (*raft.SnapshotMeta, io.ReadCloser, error) {
+	meta, r, err := st.local.Open(id)
+	if err == nil {
+		return meta, r, nil
+	}
+	if st.remoteBase == "" {
+		return nil, nil, err
+	}
+	st.lg.Printf("snapshot %s not found locally, pulling from %s", id, st.remoteBase)
+	resp, err := st.client.Get(st.remoteBase + "/snapshots/" + id)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, nil, fmt.Errorf("remote %s returned %s fetching snapshot %s", st.remoteBase, resp.Status, id)
+	}
+	var remoteMeta raft.SnapshotMeta
+	if hdr := resp.Header.Get("X-Snapshot-Meta"); hdr != "" {
+		if jsonErr := json.Unmarshal([]byte(hdr), &remoteMeta); jsonErr != nil {
+			resp.Body.Close()
+			return nil, nil, jsonErr
+		}
+	}
+	return &remoteMeta, resp.Body, nil
+}
+
+// SnapshotHTTPHandler serves a node's local snapshots for other nodes'
+// HTTPSnapshotStore to pull: GET /snapshots lists available metadata, and
+// GET /snapshots/{id} streams a snapshot's bytes with its metadata in the
+// X-Snapshot-Meta header.
+func SnapshotHTTPHandler(store raft.SnapshotStore) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/snapshots", func(w http.ResponseWriter, r *http.Request) {
+		metas, err := store.List()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(metas)
+	})
+	mux.HandleFunc("/snapshots/", func(w http.ResponseWriter, r *http.Request) {
+		id := r.URL.Path[len("/snapshots/"):]
+		meta, rc, err := store.Open(id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		defer rc.Close()
+		metaBytes, _ := json.Marshal(meta)
+		w.Header().Set("X-Snapshot-Meta", string(metaBytes))
+		io.Copy(w, rc)
+	})
+	return mux
+}
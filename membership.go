@@ -0,0 +1,83 @@
+package flotilla
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// AddPeer adds newPeer as a voting member of the cluster.  Only the leader
+// can actually execute the raft configuration change; if called on a
+// follower, the request is forwarded to the current leader over the
+// flotilla RPC layer (mirroring Command()'s dispatchToLeader).
+func (s *server) AddPeer(newPeer net.Addr) error {
+	if s.IsLeader() {
+		if err := s.raft.AddPeer(newPeer).Error(); err != nil {
+			return err
+		}
+		s.emit(Event{Type: EventPeerAdded, Peer: newPeer})
+		return nil
+	}
+	return s.forwardPeerChange(newPeer, true)
+}
+
+// RemovePeer removes deadPeer from the cluster, forwarding to the leader
+// if this node isn't it.
+func (s *server) RemovePeer(deadPeer net.Addr) error {
+	if s.IsLeader() {
+		if err := s.raft.RemovePeer(deadPeer).Error(); err != nil {
+			return err
+		}
+		s.emit(Event{Type: EventPeerRemoved, Peer: deadPeer})
+		return nil
+	}
+	return s.forwardPeerChange(deadPeer, false)
+}
+
+// Peers returns the current set of raft peers, including ourself.  Proxy
+// nodes have no *raft.Raft of their own (see newProxyServer) and aren't
+// part of the voting set, so they report no peers rather than
+// dereferencing a nil s.raft.
+func (s *server) Peers() []net.Addr {
+	if s.isProxy {
+		return nil
+	}
+	peers, err := s.raft.Peers()
+	if err != nil {
+		s.lg.Printf("ERROR reading peer set : %s", err)
+		return nil
+	}
+	return peers
+}
+
+// JoinCluster dials an existing member of a running cluster and asks it to
+// add us as a peer.  It's meant to be called by a freshly bootstrapped node
+// (one started with an empty peer list) that wants to join that cluster
+// instead of running as its own single-node leader.
+func (s *server) JoinCluster(existingPeer string) error {
+	conn, err := s.rpcLayer.Dial(existingPeer, 1*time.Minute)
+	if err != nil {
+		return fmt.Errorf("JoinCluster couldn't dial %s : %s", existingPeer, err)
+	}
+	joinConn, err := newConnToLeader(conn, s.rpcLayer.Addr().String(), s.lg)
+	if err != nil {
+		return err
+	}
+	defer joinConn.c.Close()
+	return joinConn.forwardAddPeer(s.rpcLayer.Addr())
+}
+
+// forwardPeerChange ships an AddPeer/RemovePeer request to the current
+// leader, reusing the same leader connection Command() forwarding keeps
+// open.
+func (s *server) forwardPeerChange(peer net.Addr, add bool) error {
+	s.leaderLock.Lock()
+	defer s.leaderLock.Unlock()
+	if err := s.ensureLeaderConnLocked(); err != nil {
+		return err
+	}
+	if add {
+		return s.leaderConn.forwardAddPeer(peer)
+	}
+	return s.leaderConn.forwardRemovePeer(peer)
+}
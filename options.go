@@ -0,0 +1,61 @@
+package flotilla
+
+import (
+	"crypto/tls"
+	"time"
+
+	"github.com/jbooth/raft"
+)
+
+// Options carries the less commonly tuned knobs for NewDB.  The zero value
+// preserves today's behavior: every node is a full voting raft peer.
+type Options struct {
+	// Proxy marks this node as a non-voting learner: it replicates reads
+	// via the state machine's MDB but never joins raft's peer set, log
+	// replication or quorum.  Command() calls are forwarded to the leader.
+	Proxy bool
+
+	// ActiveSize caps the number of voting peers the leader maintains.
+	// When a voting peer is demoted (see PromotionDelay), the leader
+	// promotes an eligible proxy to fill the slot.  Zero leaves the
+	// voting set unmanaged.
+	ActiveSize int
+
+	// PromotionDelay is how long a voting peer may stay unreachable
+	// before the leader demotes it via RemovePeer and promotes a
+	// replicated proxy via AddPeer.  Zero disables demotion/promotion.
+	PromotionDelay time.Duration
+
+	// SnapshotStore overrides where raft snapshots are written.  Nil (the
+	// default) keeps today's behavior of a raft.NewFileSnapshotStoreLog
+	// rooted in dataDir/raft.  See NewS3SnapshotStore and
+	// NewHTTPSnapshotStore for shipping snapshots off-box.
+	SnapshotStore raft.SnapshotStore
+
+	// SnapshotRetain is how many snapshots to keep around; older ones are
+	// pruned in the background.  Zero defaults to 1, matching today's
+	// hard-coded behavior.  It applies only to the default local file
+	// store; a SnapshotStore given above keeps the retention it was built
+	// with.
+	SnapshotRetain int
+
+	// TLSConfig, if set, wraps the mux's listener and dialer in TLS.
+	TLSConfig *tls.Config
+
+	// ClusterToken, if set, requires every connection accepted on the mux
+	// to prove knowledge of this shared secret (via HMAC-of-a-nonce)
+	// before it's dispatched to the raft or flotilla layer.  Unauthenticated
+	// peers are logged and dropped rather than served.
+	ClusterToken string
+
+	// LeaderLease lets the leader skip LinearizableRead's confirm-leadership
+	// heartbeat when it verified leadership more recently than its
+	// election timeout -- the etcd/raft "lease read" optimization.  False
+	// (the default) confirms with a heartbeat round on every call.
+	LeaderLease bool
+
+	// Metrics receives counters/histograms from Command(), dispatchToLeader()
+	// and serveFollowers().  Nil (the default) discards them; plug in a
+	// Prometheus or expvar-backed implementation to make them observable.
+	Metrics Metrics
+}
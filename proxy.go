@@ -0,0 +1,200 @@
+package flotilla
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/jbooth/raft"
+)
+
+// newProxyServer builds a non-voting learner: rather than running raft, it
+// tails the leader's applied-command stream over the flotilla RPC layer
+// and replays each command straight into its own MDB via state.  Command()
+// calls are forwarded to the leader like any follower's; Read() is served
+// from the locally replicated MDB.
+func newProxyServer(
+	peers []string,
+	state *flotillaState,
+	rpcLayer raft.StreamLayer,
+	lg *log.Logger,
+	metrics Metrics,
+	events chan Event) (*server, error) {
+
+	if len(peers) == 0 {
+		return nil, fmt.Errorf("proxy nodes need at least one existing peer to replicate from")
+	}
+	s := &server{
+		state:      state,
+		peers:      peers,
+		rpcLayer:   rpcLayer,
+		leaderLock: new(sync.Mutex),
+		lg:         lg,
+		isProxy:    true,
+		metrics:    metrics,
+		events:     events,
+		closeCh:    make(chan struct{}),
+	}
+	if err := s.refreshProxyLeader(); err != nil {
+		return nil, err
+	}
+	go s.tailLeader()
+	return s, nil
+}
+
+// refreshProxyLeader dials the configured peers in turn until one reports
+// who the current leader is, recording the result as s.proxyLeader.
+func (s *server) refreshProxyLeader() error {
+	var lastErr error
+	for _, p := range s.peers {
+		conn, err := s.rpcLayer.Dial(p, 1*time.Minute)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		probe, err := newConnToLeader(conn, s.rpcLayer.Addr().String(), s.lg)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		leaderAddr, err := probe.queryLeader()
+		probe.c.Close()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		s.proxyLeader = leaderAddr
+		return nil
+	}
+	return fmt.Errorf("proxy couldn't find a leader among %+v : %s", s.peers, lastErr)
+}
+
+// tailLeader keeps a replication stream open to the leader for the life of
+// the proxy, re-resolving the leader and reconnecting on any error.  It
+// exits once Close() closes s.closeCh.
+func (s *server) tailLeader() {
+	for {
+		err := s.tailOnce()
+		select {
+		case <-s.closeCh:
+			return
+		default:
+		}
+		s.lg.Printf("proxy replication from %s ended, reconnecting : %s", s.proxyLeader, err)
+		time.Sleep(1 * time.Second)
+		if err := s.refreshProxyLeader(); err != nil {
+			s.lg.Printf("proxy couldn't re-find leader : %s", err)
+		}
+	}
+}
+
+func (s *server) tailOnce() error {
+	conn, err := s.rpcLayer.Dial(s.proxyLeader.String(), 1*time.Minute)
+	if err != nil {
+		return err
+	}
+	s.proxyConnMu.Lock()
+	s.proxyConn = conn
+	s.proxyConnMu.Unlock()
+	defer func() {
+		conn.Close()
+		s.proxyConnMu.Lock()
+		if s.proxyConn == conn {
+			s.proxyConn = nil
+		}
+		s.proxyConnMu.Unlock()
+	}()
+	applied, err := subscribeReplication(conn, s.rpcLayer.Addr().String())
+	if err != nil {
+		return err
+	}
+	for entry := range applied {
+		if err := s.state.ApplyReplicated(entry.Index, entry.Bytes); err != nil {
+			s.lg.Printf("ERROR applying replicated entry at index %d : %s", entry.Index, err)
+		}
+	}
+	return fmt.Errorf("replication stream from %s closed", s.proxyLeader)
+}
+
+// monitorPeerHealth runs on the leader only, demoting voting peers that
+// have been unreachable for longer than promotionDelay and promoting an
+// eligible proxy in their place, keeping the voting set near activeSize.
+func (s *server) monitorPeerHealth(activeSize int, promotionDelay time.Duration) {
+	// Seed every currently-voting peer as seen right now: an empty map
+	// would make time.Since(lastSeen[p]) return decades for any peer not
+	// yet recorded (the zero Time), demoting it on the very first tick
+	// instead of waiting out promotionDelay.
+	lastSeen := map[string]time.Time{}
+	now := time.Now()
+	for _, p := range s.Peers() {
+		lastSeen[p.String()] = now
+	}
+	ticker := time.NewTicker(promotionDelay / 4)
+	defer ticker.Stop()
+	for range ticker.C {
+		if !s.IsLeader() {
+			// Reachability isn't tracked while we're not leader, so start
+			// every peer's clock afresh once we are.
+			lastSeen = map[string]time.Time{}
+			continue
+		}
+		votingPeers := s.Peers()
+		for _, p := range votingPeers {
+			if _, ok := lastSeen[p.String()]; !ok {
+				lastSeen[p.String()] = time.Now()
+			}
+			conn, err := s.rpcLayer.Dial(p.String(), 5*time.Second)
+			if err == nil {
+				conn.Close()
+				lastSeen[p.String()] = time.Now()
+				continue
+			}
+			if !peerDemotable(lastSeen[p.String()], promotionDelay, time.Now()) {
+				continue
+			}
+			s.lg.Printf("demoting unreachable voting peer %s after %s", p, promotionDelay)
+			if err := s.raft.RemovePeer(p).Error(); err != nil {
+				s.lg.Printf("ERROR demoting peer %s : %s", p, err)
+				continue
+			}
+			s.emit(Event{Type: EventPeerRemoved, Peer: p})
+			delete(lastSeen, p.String())
+			if len(votingPeers)-1 < activeSize {
+				if promoted := s.pickPromotablePeer(votingPeers); promoted != nil {
+					if err := s.raft.AddPeer(promoted).Error(); err != nil {
+						s.lg.Printf("ERROR promoting proxy %s : %s", promoted, err)
+					} else {
+						s.emit(Event{Type: EventPeerAdded, Peer: promoted})
+					}
+				}
+			}
+		}
+	}
+}
+
+// peerDemotable reports whether a voting peer last seen at lastSeen has
+// been unreachable long enough (as of now) to demote -- split out of
+// monitorPeerHealth's loop so the threshold math is testable without a
+// running raft cluster.
+func peerDemotable(lastSeen time.Time, promotionDelay time.Duration, now time.Time) bool {
+	return now.Sub(lastSeen) >= promotionDelay
+}
+
+// pickPromotablePeer returns an address the leader can promote in place
+// of a voting peer it just demoted.  Candidates come from s.proxies, the
+// registry of non-voting learners currently tailing our replication
+// stream (registerProxy/unregisterProxy in rpc.go) -- s.peers is the
+// configured voting set itself, so checking candidates from it against
+// the voting list can never find one that isn't already voting.
+func (s *server) pickPromotablePeer(voting []net.Addr) net.Addr {
+	s.proxiesLock.Lock()
+	defer s.proxiesLock.Unlock()
+	for _, addr := range s.proxies {
+		if !raft.PeerContained(voting, addr) {
+			return addr
+		}
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package flotilla
+
+import (
+	"io/ioutil"
+	"log"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPeerDemotable(t *testing.T) {
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	delay := 10 * time.Second
+	cases := []struct {
+		name     string
+		lastSeen time.Time
+		want     bool
+	}{
+		{"just seen", now.Add(-1 * time.Second), false},
+		{"right at the threshold", now.Add(-delay), true},
+		{"well past the threshold", now.Add(-1 * time.Hour), true},
+		{"never seen (zero Time) is well past the threshold", time.Time{}, true},
+	}
+	for _, c := range cases {
+		if got := peerDemotable(c.lastSeen, delay, now); got != c.want {
+			t.Errorf("%s: peerDemotable() = %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func mustResolve(t *testing.T, addr string) net.Addr {
+	t.Helper()
+	a, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		t.Fatalf("resolving %s: %s", addr, err)
+	}
+	return a
+}
+
+func TestPickPromotablePeerIgnoresVotingPeers(t *testing.T) {
+	s := &server{proxiesLock: new(sync.Mutex), proxies: make(map[string]net.Addr)}
+	voting := []net.Addr{mustResolve(t, "10.0.0.1:7000"), mustResolve(t, "10.0.0.2:7000")}
+
+	if got := s.pickPromotablePeer(voting); got != nil {
+		t.Fatalf("expected no promotable peer with an empty proxy registry, got %s", got)
+	}
+
+	// A proxy that's already voting (e.g. a stale registration) isn't a
+	// valid promotion candidate.
+	s.registerProxy("10.0.0.1:7000")
+	if got := s.pickPromotablePeer(voting); got != nil {
+		t.Fatalf("expected no promotable peer when the only registered proxy is already voting, got %s", got)
+	}
+
+	s.registerProxy("10.0.0.3:7000")
+	got := s.pickPromotablePeer(voting)
+	if got == nil || got.String() != "10.0.0.3:7000" {
+		t.Fatalf("expected to promote 10.0.0.3:7000, got %v", got)
+	}
+}
+
+func TestRegisterUnregisterProxy(t *testing.T) {
+	s := &server{proxiesLock: new(sync.Mutex), proxies: make(map[string]net.Addr), lg: log.New(ioutil.Discard, "", 0)}
+	s.registerProxy("10.0.0.4:7000")
+	s.proxiesLock.Lock()
+	_, ok := s.proxies["10.0.0.4:7000"]
+	s.proxiesLock.Unlock()
+	if !ok {
+		t.Fatal("expected 10.0.0.4:7000 to be registered")
+	}
+	s.unregisterProxy("10.0.0.4:7000")
+	s.proxiesLock.Lock()
+	_, ok = s.proxies["10.0.0.4:7000"]
+	s.proxiesLock.Unlock()
+	if ok {
+		t.Fatal("expected 10.0.0.4:7000 to be unregistered")
+	}
+}
@@ -0,0 +1,80 @@
+package flotilla
+
+import (
+	"fmt"
+	"time"
+
+	mdb "github.com/jbooth/gomdb"
+)
+
+// LinearizableRead implements the etcd/Raft read-index protocol: it hands
+// back an MDB read transaction that reflects every command committed at
+// the moment this call was made, without paying for a full raft.Apply()
+// round-trip the way Rsync() does today.
+//
+// On the leader, it records the current log index, confirms leadership is
+// still held by a quorum (skipped when LeaderLease is enabled and the
+// election timeout hasn't elapsed since the last confirmed contact), then
+// blocks until the local FSM has applied that index before handing back a
+// read txn.  On a follower, the read-index request is forwarded to the
+// leader over the flotilla RPC layer, then this node waits locally for its
+// own state to catch up to the index the leader returns.
+func (s *server) LinearizableRead() (*mdb.Txn, error) {
+	idx, err := s.readIndex()
+	if err != nil {
+		return nil, err
+	}
+	if err := s.state.WaitForIndex(idx, commandTimeout); err != nil {
+		return nil, err
+	}
+	return s.state.ReadTxn()
+}
+
+// readIndex returns a raft log index that's safe to read from once our
+// FSM has applied it: every command committed as of this call is
+// guaranteed to be at or before it.
+func (s *server) readIndex() (uint64, error) {
+	if s.isProxy {
+		return 0, fmt.Errorf("LinearizableRead isn't supported on proxy nodes; use Read() instead")
+	}
+	if !s.IsLeader() {
+		return s.forwardReadIndex()
+	}
+	idx := s.raft.LastIndex()
+	if !s.leaderLeaseValid() {
+		if err := s.raft.VerifyLeader().Error(); err != nil {
+			return 0, err
+		}
+		s.recordVerified()
+	}
+	return idx, nil
+}
+
+// leaderLeaseValid reports whether we confirmed leadership against a
+// quorum more recently than our election timeout, letting LinearizableRead
+// skip another confirm-leadership heartbeat.
+func (s *server) leaderLeaseValid() bool {
+	if !s.leaderLease {
+		return false
+	}
+	s.leaseLock.Lock()
+	defer s.leaseLock.Unlock()
+	return time.Since(s.lastVerified) < s.heartbeatTimeout
+}
+
+func (s *server) recordVerified() {
+	s.leaseLock.Lock()
+	defer s.leaseLock.Unlock()
+	s.lastVerified = time.Now()
+}
+
+// forwardReadIndex asks the leader for a read index over the same leader
+// connection Command() forwarding keeps open.
+func (s *server) forwardReadIndex() (uint64, error) {
+	s.leaderLock.Lock()
+	defer s.leaderLock.Unlock()
+	if err := s.ensureLeaderConnLocked(); err != nil {
+		return 0, err
+	}
+	return s.leaderConn.forwardReadIndex()
+}
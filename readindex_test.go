@@ -0,0 +1,49 @@
+package flotilla
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLeaderLeaseValid(t *testing.T) {
+	heartbeat := 100 * time.Millisecond
+
+	s := &server{leaseLock: new(sync.Mutex), heartbeatTimeout: heartbeat}
+	if s.leaderLeaseValid() {
+		t.Fatal("lease should be invalid when LeaderLease is disabled, regardless of lastVerified")
+	}
+
+	s.leaderLease = true
+	if s.leaderLeaseValid() {
+		t.Fatal("lease should be invalid before leadership has ever been verified (zero lastVerified)")
+	}
+
+	s.recordVerified()
+	if !s.leaderLeaseValid() {
+		t.Fatal("lease should be valid immediately after recordVerified")
+	}
+
+	s.leaseLock.Lock()
+	s.lastVerified = time.Now().Add(-2 * heartbeat)
+	s.leaseLock.Unlock()
+	if s.leaderLeaseValid() {
+		t.Fatal("lease should be invalid once heartbeatTimeout has elapsed since the last verification")
+	}
+}
+
+func TestRecordVerifiedIsConcurrencySafe(t *testing.T) {
+	s := &server{leaseLock: new(sync.Mutex), heartbeatTimeout: time.Second, leaderLease: true}
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.recordVerified()
+		}()
+	}
+	wg.Wait()
+	if !s.leaderLeaseValid() {
+		t.Fatal("expected lease to be valid after concurrent recordVerified calls")
+	}
+}
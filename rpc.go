@@ -0,0 +1,331 @@
+package flotilla
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+)
+
+// rpcOp identifies which verb a frame on the flotilla RPC connection
+// carries.  Every frame after the initial dial-code byte (see
+// NewMultiStream) rides the same persistent, gob-framed connection a
+// follower or proxy keeps open to the current leader.
+type rpcOp byte
+
+const (
+	opCommand rpcOp = iota
+	opAddPeer
+	opRemovePeer
+	opQueryLeader
+	opReadIndex
+	// opSubscribeReplication hijacks the connection for the life of the
+	// subscription: after the initial rpcRequest, the leader streams
+	// appliedEntry frames (not rpcResponses) until the connection breaks.
+	// See serveReplicationStream / proxy.go's tailOnce.
+	opSubscribeReplication
+)
+
+// rpcRequest is one frame sent from a follower (or proxy) to the leader.
+type rpcRequest struct {
+	Op       rpcOp
+	ReqNo    uint64
+	Origin   string
+	Cmd      string
+	Args     [][]byte
+	PeerAddr string
+}
+
+// rpcResponse answers an rpcRequest, matched back to the caller by ReqNo.
+// opCommand gets no rpcResponse: its result arrives later, once the
+// command's raft log entry replicates back to the requester and its own
+// FSM.Apply resolves the pending commandCallback (see flotillaState.Apply).
+type rpcResponse struct {
+	ReqNo      uint64
+	Err        string
+	LeaderAddr string
+	Index      uint64
+}
+
+// logEntry is what bytesForCommand encodes into the raft log: enough to
+// both execute the command and, on whichever node originated it, resolve
+// the matching pending commandCallback once the entry is applied.
+type logEntry struct {
+	OriginAddr string
+	ReqNo      uint64
+	Cmd        string
+	Args       [][]byte
+}
+
+// bytesForCommand is the wire format raft.Apply() is given: gob-encoded
+// so every node's flotillaState.Apply can decode it identically.
+func bytesForCommand(originAddr string, reqNo uint64, cmd string, args [][]byte) []byte {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(logEntry{originAddr, reqNo, cmd, args}); err != nil {
+		// logEntry is plain strings/byte slices; gob can't fail on it.
+		panic(err)
+	}
+	return buf.Bytes()
+}
+
+// connToLeader is the persistent, gob-framed connection a follower (or
+// proxy) keeps open to the current leader for forwarding Command/AddPeer/
+// RemovePeer requests.  Command forwarding is fire-and-forget over send();
+// AddPeer/RemovePeer are request/response, matched by ReqNo via call().
+type connToLeader struct {
+	c          net.Conn
+	originAddr string
+	lg         *log.Logger
+	enc        *gob.Encoder
+	dec        *gob.Decoder
+
+	writeMu   sync.Mutex
+	nextReqNo uint64
+
+	pendingMu sync.Mutex
+	pending   map[uint64]chan rpcResponse
+}
+
+func newConnToLeader(c net.Conn, originAddr string, lg *log.Logger) (*connToLeader, error) {
+	cl := &connToLeader{
+		c:          c,
+		originAddr: originAddr,
+		lg:         lg,
+		enc:        gob.NewEncoder(c),
+		dec:        gob.NewDecoder(c),
+		pending:    make(map[uint64]chan rpcResponse),
+	}
+	go cl.readLoop()
+	return cl, nil
+}
+
+func (cl *connToLeader) remoteAddr() net.Addr { return cl.c.RemoteAddr() }
+
+// readLoop decodes rpcResponses for the life of the connection, handing
+// each to whichever call() is waiting on its ReqNo.  It exits (and fails
+// any calls still waiting) once the connection breaks.
+func (cl *connToLeader) readLoop() {
+	for {
+		var resp rpcResponse
+		if err := cl.dec.Decode(&resp); err != nil {
+			cl.failAllPending(err)
+			return
+		}
+		cl.pendingMu.Lock()
+		ch, ok := cl.pending[resp.ReqNo]
+		if ok {
+			delete(cl.pending, resp.ReqNo)
+		}
+		cl.pendingMu.Unlock()
+		if ok {
+			ch <- resp
+		}
+	}
+}
+
+func (cl *connToLeader) failAllPending(err error) {
+	cl.pendingMu.Lock()
+	defer cl.pendingMu.Unlock()
+	for reqNo, ch := range cl.pending {
+		ch <- rpcResponse{ReqNo: reqNo, Err: err.Error()}
+		delete(cl.pending, reqNo)
+	}
+}
+
+func (cl *connToLeader) send(req rpcRequest) error {
+	cl.writeMu.Lock()
+	defer cl.writeMu.Unlock()
+	return cl.enc.Encode(req)
+}
+
+// call sends req (stamping it with a fresh ReqNo) and blocks for its
+// matching rpcResponse.
+func (cl *connToLeader) call(req rpcRequest) (rpcResponse, error) {
+	ch := make(chan rpcResponse, 1)
+	cl.pendingMu.Lock()
+	cl.nextReqNo++
+	req.ReqNo = cl.nextReqNo
+	cl.pending[req.ReqNo] = ch
+	cl.pendingMu.Unlock()
+	if err := cl.send(req); err != nil {
+		cl.pendingMu.Lock()
+		delete(cl.pending, req.ReqNo)
+		cl.pendingMu.Unlock()
+		return rpcResponse{}, err
+	}
+	resp := <-ch
+	if resp.Err != "" {
+		return resp, fmt.Errorf(resp.Err)
+	}
+	return resp, nil
+}
+
+// forwardCommand ships cmd/args to the leader for cb to eventually be
+// resolved by.  It's fire-and-forget: the leader applies it via raft with
+// cb's originAddr/reqNo embedded, and the result reaches cb.result once
+// that entry replicates back to this node's own FSM.Apply.
+func (cl *connToLeader) forwardCommand(cb *commandCallback, cmd string, args [][]byte) error {
+	return cl.send(rpcRequest{Op: opCommand, ReqNo: cb.reqNo, Origin: cb.originAddr, Cmd: cmd, Args: args})
+}
+
+// forwardAddPeer asks the leader to add newPeer as a voting member,
+// blocking for its response.
+func (cl *connToLeader) forwardAddPeer(newPeer net.Addr) error {
+	_, err := cl.call(rpcRequest{Op: opAddPeer, PeerAddr: newPeer.String()})
+	return err
+}
+
+// forwardRemovePeer asks the leader to remove deadPeer, blocking for its
+// response.
+func (cl *connToLeader) forwardRemovePeer(deadPeer net.Addr) error {
+	_, err := cl.call(rpcRequest{Op: opRemovePeer, PeerAddr: deadPeer.String()})
+	return err
+}
+
+// queryLeader asks whoever's on the other end of this connection who the
+// current leader is -- used by a proxy bootstrapping or re-finding a
+// leader to tail, not necessarily the leader itself.
+func (cl *connToLeader) queryLeader() (net.Addr, error) {
+	resp, err := cl.call(rpcRequest{Op: opQueryLeader})
+	if err != nil {
+		return nil, err
+	}
+	if resp.LeaderAddr == "" {
+		return nil, fmt.Errorf("no leader known on the other end of %s", cl.remoteAddr())
+	}
+	return net.ResolveTCPAddr("tcp", resp.LeaderAddr)
+}
+
+// forwardReadIndex asks the leader for a raft log index that's safe to
+// read from once this node's own FSM has applied it, blocking for the
+// response.
+func (cl *connToLeader) forwardReadIndex() (uint64, error) {
+	resp, err := cl.call(rpcRequest{Op: opReadIndex})
+	if err != nil {
+		return 0, err
+	}
+	return resp.Index, nil
+}
+
+// subscribeReplication claims conn exclusively for the life of the
+// subscription: it announces originAddr to the leader, then returns a
+// channel the leader streams every subsequently-applied command entry on.
+// It does not use connToLeader's generic call()/readLoop machinery, since
+// after the initial request the wire format switches from rpcResponse
+// frames to appliedEntry frames.
+func subscribeReplication(conn net.Conn, originAddr string) (<-chan appliedEntry, error) {
+	enc := gob.NewEncoder(conn)
+	if err := enc.Encode(rpcRequest{Op: opSubscribeReplication, Origin: originAddr}); err != nil {
+		return nil, err
+	}
+	out := make(chan appliedEntry, 256)
+	go func() {
+		defer close(out)
+		dec := gob.NewDecoder(conn)
+		for {
+			var entry appliedEntry
+			if err := dec.Decode(&entry); err != nil {
+				return
+			}
+			out <- entry
+		}
+	}()
+	return out, nil
+}
+
+// serveFollower is the leader side of a single follower/proxy connection:
+// it decodes requests and dispatches each to s, writing back a response
+// for the ops that need one.
+func serveFollower(lg *log.Logger, conn net.Conn, s *server) {
+	defer conn.Close()
+	dec := gob.NewDecoder(conn)
+	enc := gob.NewEncoder(conn)
+	var writeMu sync.Mutex
+	write := func(resp rpcResponse) {
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		if err := enc.Encode(resp); err != nil {
+			lg.Printf("ERROR writing response to %s : %s", conn.RemoteAddr(), err)
+		}
+	}
+	for {
+		var req rpcRequest
+		if err := dec.Decode(&req); err != nil {
+			return
+		}
+		if req.Op == opSubscribeReplication {
+			// Claims conn for the life of the subscription; no more
+			// requests will be decoded off it.
+			s.serveReplicationStream(req, conn, enc)
+			return
+		}
+		go s.handleRPC(req, write)
+	}
+}
+
+// handleRPC dispatches a single decoded request to the matching local
+// method.  opCommand applies directly via raft with the requester's
+// origin embedded and sends no response; opAddPeer/opRemovePeer call the
+// same AddPeer/RemovePeer a local caller would use and report the result.
+func (s *server) handleRPC(req rpcRequest, write func(rpcResponse)) {
+	switch req.Op {
+	case opCommand:
+		cmdBytes := bytesForCommand(req.Origin, req.ReqNo, req.Cmd, req.Args)
+		s.raft.Apply(cmdBytes, commandTimeout)
+	case opAddPeer:
+		resp := rpcResponse{ReqNo: req.ReqNo}
+		addr, err := net.ResolveTCPAddr("tcp", req.PeerAddr)
+		if err == nil {
+			err = s.AddPeer(addr)
+		}
+		if err != nil {
+			resp.Err = err.Error()
+		}
+		write(resp)
+	case opRemovePeer:
+		resp := rpcResponse{ReqNo: req.ReqNo}
+		addr, err := net.ResolveTCPAddr("tcp", req.PeerAddr)
+		if err == nil {
+			err = s.RemovePeer(addr)
+		}
+		if err != nil {
+			resp.Err = err.Error()
+		}
+		write(resp)
+	case opQueryLeader:
+		resp := rpcResponse{ReqNo: req.ReqNo}
+		if leader := s.Leader(); leader != nil {
+			resp.LeaderAddr = leader.String()
+		}
+		write(resp)
+	case opReadIndex:
+		resp := rpcResponse{ReqNo: req.ReqNo}
+		idx, err := s.readIndex()
+		resp.Index = idx
+		if err != nil {
+			resp.Err = err.Error()
+		}
+		write(resp)
+	default:
+		s.lg.Printf("ERROR unknown RPC op %d from %s", req.Op, s.rpcLayer.Addr())
+	}
+}
+
+// serveReplicationStream is the leader side of a proxy's tailOnce: it
+// records the proxy as a promotion candidate (see pickPromotablePeer),
+// subscribes to every subsequently-applied command, and streams them back
+// over enc until the connection breaks or the proxy disconnects.
+func (s *server) serveReplicationStream(req rpcRequest, conn net.Conn, enc *gob.Encoder) {
+	s.registerProxy(req.Origin)
+	defer s.unregisterProxy(req.Origin)
+	sub := s.state.subscribe()
+	defer s.state.unsubscribe(sub)
+	for entry := range sub.ch {
+		if err := enc.Encode(entry); err != nil {
+			s.lg.Printf("replication stream to %s ended : %s", req.Origin, err)
+			return
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package flotilla
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/jbooth/raft"
+)
+
+// S3SnapshotStore persists raft snapshots as objects in an S3 bucket so a
+// leader's snapshots can be shipped off-box and used to rehydrate a brand
+// new cluster, rather than living only on local disk.
+type S3SnapshotStore struct {
+	client *s3.S3
+	bucket string
+	prefix string
+	retain int
+	lg     *log.Logger
+}
+
+// NewS3SnapshotStore builds a SnapshotStore that writes through to bucket
+// under prefix, keeping at most retain snapshots and pruning older ones
+// in the background after each Create.
+func NewS3SnapshotStore(client *s3.S3, bucket, prefix string, retain int, lg *log.Logger) *S3SnapshotStore {
+	if retain <= 0 {
+		retain = 1
+	}
+	return &S3SnapshotStore{client, bucket, strings.TrimSuffix(prefix, "/"), retain, lg}
+}
+
+type s3SnapshotMeta struct {
+	ID    string `json:"id"`
+	Index uint64 `json:"index"`
+	Term  uint64 `json:"term"`
+	Peers []byte `json:"peers"`
+	Size  int64  `json:"size"`
+}
+
+func (st *S3SnapshotStore) metaKey(id string) string { return fmt.Sprintf("%s/%s.meta", st.prefix, id) }
+func (st *S3SnapshotStore) dataKey(id string) string { return fmt.Sprintf("%s/%s.data", st.prefix, id) }
+
+// Create begins a new snapshot; writes are buffered locally and uploaded
+// to S3 when the sink is closed.
+func (st *S3SnapshotStore) Create(index, term uint64, peers []byte) (raft.SnapshotSink, error) {
+	id := fmt.Sprintf("%d-%d-%d", term, index, time.Now().UnixNano())
+	return &s3SnapshotSink{store: st, id: id, index: index, term: term, peers: peers}, nil
+}
+
+// List returns known snapshots, newest first.
+func (st *S3SnapshotStore) List() ([]*raft.SnapshotMeta, error) {
+	out, err := st.client.ListObjects(&s3.ListObjectsInput{
+		Bucket: aws.String(st.bucket),
+		Prefix: aws.String(st.prefix + "/"),
+	})
+	if err != nil {
+		return nil, err
+	}
+	metas := make([]*raft.SnapshotMeta, 0, len(out.Contents))
+	for _, obj := range out.Contents {
+		if obj.Key == nil || !strings.HasSuffix(*obj.Key, ".meta") {
+			continue
+		}
+		m, err := st.readMeta(*obj.Key)
+		if err != nil {
+			st.lg.Printf("ERROR reading snapshot meta %s : %s", *obj.Key, err)
+			continue
+		}
+		metas = append(metas, m)
+	}
+	sort.Slice(metas, func(i, j int) bool { return metas[i].Index > metas[j].Index })
+	return metas, nil
+}
+
+// Open returns the metadata and a reader for the snapshot's data.
+func (st *S3SnapshotStore) Open(id string) (*raft.SnapshotMeta, io.ReadCloser, error) {
+	m, err := st.readMeta(st.metaKey(id))
+	if err != nil {
+		return nil, nil, err
+	}
+	obj, err := st.client.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(st.bucket),
+		Key:    aws.String(st.dataKey(id)),
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return m, obj.Body, nil
+}
+
+func (st *S3SnapshotStore) readMeta(key string) (*raft.SnapshotMeta, error) {
+	obj, err := st.client.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(st.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer obj.Body.Close()
+	raw, err := ioutil.ReadAll(obj.Body)
+	if err != nil {
+		return nil, err
+	}
+	var sm s3SnapshotMeta
+	if err := json.Unmarshal(raw, &sm); err != nil {
+		return nil, err
+	}
+	return &raft.SnapshotMeta{ID: sm.ID, Index: sm.Index, Term: sm.Term, Peers: sm.Peers, Size: sm.Size}, nil
+}
+
+// prune removes all but the retain most recent snapshots, logging but not
+// failing the calling Create() on error -- pruning is best-effort.
+func (st *S3SnapshotStore) prune() {
+	metas, err := st.List()
+	if err != nil {
+		st.lg.Printf("ERROR listing snapshots for pruning : %s", err)
+		return
+	}
+	for _, m := range metas[min(st.retain, len(metas)):] {
+		_, err := st.client.DeleteObject(&s3.DeleteObjectInput{Bucket: aws.String(st.bucket), Key: aws.String(st.metaKey(m.ID))})
+		if err != nil {
+			st.lg.Printf("ERROR pruning snapshot %s : %s", m.ID, err)
+			continue
+		}
+		_, err = st.client.DeleteObject(&s3.DeleteObjectInput{Bucket: aws.String(st.bucket), Key: aws.String(st.dataKey(m.ID))})
+		if err != nil {
+			st.lg.Printf("ERROR pruning snapshot %s : %s", m.ID, err)
+		}
+	}
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// s3SnapshotSink buffers a snapshot's bytes locally and uploads them (plus
+// a small JSON meta object) to S3 on Close.
+type s3SnapshotSink struct {
+	store    *S3SnapshotStore
+	id       string
+	index    uint64
+	term     uint64
+	peers    []byte
+	buf      bytes.Buffer
+	canceled bool
+}
+
+func (sink *s3SnapshotSink) Write(p []byte) (int, error) { return sink.buf.Write(p) }
+
+func (sink *s3SnapshotSink) ID() string { return sink.id }
+
+func (sink *s3SnapshotSink) Cancel() error {
+	sink.canceled = true
+	return nil
+}
+
+func (sink *s3SnapshotSink) Close() error {
+	if sink.canceled {
+		return nil
+	}
+	st := sink.store
+	meta := s3SnapshotMeta{ID: sink.id, Index: sink.index, Term: sink.term, Peers: sink.peers, Size: int64(sink.buf.Len())}
+	metaBytes, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	if _, err := st.client.PutObject(&s3.PutObjectInput{
+		Bucket: aws.String(st.bucket),
+		Key:    aws.String(st.dataKey(sink.id)),
+		Body:   bytes.NewReader(sink.buf.Bytes()),
+	}); err != nil {
+		return err
+	}
+	if _, err := st.client.PutObject(&s3.PutObjectInput{
+		Bucket: aws.String(st.bucket),
+		Key:    aws.String(st.metaKey(sink.id)),
+		Body:   bytes.NewReader(metaBytes),
+	}); err != nil {
+		return err
+	}
+	go st.prune()
+	return nil
+}
@@ -34,6 +34,7 @@ func NewDefaultDB(peers []string, dataDir string, bindAddr string, ops map[strin
 		defaultDialer,
 		ops,
 		log.New(os.Stderr, "flotilla", log.LstdFlags),
+		Options{},
 	)
 	if err != nil {
 		return nil, err
@@ -44,14 +45,17 @@ func NewDefaultDB(peers []string, dataDir string, bindAddr string, ops map[strin
 }
 
 // Instantiates a new DB serving the ops provided, using the provided dataDir and listener
-// If Peers is empty, we start as the sole leader.  Otherwise, connect to the existing leader.
+// If Peers is empty, we bootstrap as the sole leader of a brand new cluster; call JoinCluster
+// on subsequent nodes (or AddPeer on this one) to grow it at runtime.  Otherwise, peers must
+// name the full existing membership and this host must be among them.
 func NewDB(
 	peers []string,
 	dataDir string,
 	listen net.Listener,
 	dialer func(string, time.Duration) (net.Conn, error),
 	commands map[string]Command,
-	lg *log.Logger) (DB, error) {
+	lg *log.Logger,
+	opts Options) (DB, error) {
 	raftDir := dataDir + "/raft"
 	mdbDir := dataDir + "/mdb"
 	// make sure dirs exist
@@ -69,33 +73,63 @@ func NewDB(
 		}
 		commandsForStateMachine[cmd] = cmdExec
 	}
+	metrics := opts.Metrics
+	if metrics == nil {
+		metrics = noopMetrics{}
+	}
+	events := make(chan Event, 64)
 	state, err := newFlotillaState(
 		mdbDir,
 		commandsForStateMachine,
 		listen.Addr().String(),
 		lg,
+		metrics,
+		events,
 	)
 	if err != nil {
 		return nil, err
 	}
+	// TLS-wrap and/or require proof of the shared cluster token on every
+	// accepted connection before it ever reaches the raft/flotilla mux.
+	listen = tlsListen(listen, opts.TLSConfig)
+	listen = authenticateListener(listen, opts.ClusterToken, lg)
+	dialer = tokenDialer(dialer, opts.TLSConfig, opts.ClusterToken)
 	streamLayers, err := NewMultiStream(listen, dialer, listen.Addr(), lg, dialCodeRaft, dialCodeFlot)
 	if err != nil {
 		return nil, err
 	}
+	if opts.Proxy {
+		// proxies replicate MDB state from the leader but never join
+		// raft's peer set, log replication or quorum.
+		return newProxyServer(peers, state, streamLayers[dialCodeFlot], lg, metrics, events)
+	}
 	// start raft server
-	raft, err := newRaft(peers, raftDir, streamLayers[dialCodeRaft], state, lg)
+	heartbeatTimeout := raft.DefaultConfig().HeartbeatTimeout
+	raftServer, snapshotStore, err := newRaft(peers, raftDir, streamLayers[dialCodeRaft], state, lg, opts)
 	if err != nil {
 		return nil, err
 	}
 	s := &server{
-		raft:       raft,
-		state:      state,
-		peers:      peers,
-		rpcLayer:   streamLayers[dialCodeFlot],
-		leaderLock: new(sync.Mutex),
-		leaderConn: nil,
-		lg:         lg,
+		raft:             raftServer,
+		state:            state,
+		peers:            peers,
+		rpcLayer:         streamLayers[dialCodeFlot],
+		leaderLock:       new(sync.Mutex),
+		leaderConn:       nil,
+		lg:               lg,
+		leaderLease:      opts.LeaderLease,
+		heartbeatTimeout: heartbeatTimeout,
+		leaseLock:        new(sync.Mutex),
+		snapshotStore:    snapshotStore,
+		metrics:          metrics,
+		events:           events,
+		proxiesLock:      new(sync.Mutex),
+		proxies:          make(map[string]net.Addr),
 	}
+	if opts.ActiveSize > 0 && opts.PromotionDelay > 0 {
+		go s.monitorPeerHealth(opts.ActiveSize, opts.PromotionDelay)
+	}
+	go s.watchLeaderChanges()
 	// serve followers
 	go s.serveFollowers()
 	return s, nil
@@ -109,20 +143,83 @@ type server struct {
 	leaderLock *sync.Mutex
 	leaderConn *connToLeader
 	lg         *log.Logger
+
+	// isProxy is set on non-voting learner nodes built by newProxyServer.
+	// They have no *raft.Raft of their own: Leader()/IsLeader()/Command()
+	// fall back to proxyLeader instead of consulting raft directly.
+	isProxy     bool
+	proxyLeader net.Addr
+
+	// leaderLease and heartbeatTimeout back LinearizableRead's lease-read
+	// optimization; see leaderLeaseValid in readindex.go.
+	leaderLease      bool
+	heartbeatTimeout time.Duration
+	leaseLock        *sync.Mutex
+	lastVerified     time.Time
+
+	// snapshotStore, metrics and events back Stats()/Events(); see stats.go.
+	snapshotStore raft.SnapshotStore
+	metrics       Metrics
+	events        chan Event
+
+	// proxiesLock/proxies register the non-voting learners currently
+	// tailing our replication stream (keyed by their flotilla RPC
+	// address), so pickPromotablePeer has an actual pool of proxies to
+	// promote instead of re-checking the voting set against itself.
+	proxiesLock *sync.Mutex
+	proxies     map[string]net.Addr
+
+	// closeCh is closed by Close() on a proxy to stop tailLeader's
+	// reconnect loop; proxyConn is whichever replication connection
+	// tailOnce currently has open, closed alongside it so a blocked read
+	// on the stream doesn't keep the goroutine alive past Close().  Both
+	// are nil/unused on voting servers, which shut down via s.raft instead.
+	closeCh     chan struct{}
+	closeOnce   sync.Once
+	proxyConnMu sync.Mutex
+	proxyConn   net.Conn
 }
 
-func newRaft(peers []string, path string, streams raft.StreamLayer, state raft.FSM, lg *log.Logger) (*raft.Raft, error) {
+// registerProxy records addr as an active replication subscriber, making
+// it eligible for promotion by pickPromotablePeer.
+func (s *server) registerProxy(addr string) {
+	resolved, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		s.lg.Printf("ERROR registering proxy %s : %s", addr, err)
+		return
+	}
+	s.proxiesLock.Lock()
+	s.proxies[addr] = resolved
+	s.proxiesLock.Unlock()
+}
+
+func (s *server) unregisterProxy(addr string) {
+	s.proxiesLock.Lock()
+	delete(s.proxies, addr)
+	s.proxiesLock.Unlock()
+}
+
+func newRaft(peers []string, path string, streams raft.StreamLayer, state raft.FSM, lg *log.Logger, opts Options) (*raft.Raft, raft.SnapshotStore, error) {
 	// Create the MDB store for logs and stable storage, retain up to 8gb
 	store, err := raftmdb.NewMDBStoreWithSize(path, 8*1024*1024*1024)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	// Create the snapshot store
-	snapshots, err := raft.NewFileSnapshotStoreLog(path, 1, lg)
-	if err != nil {
-		store.Close()
-		return nil, err
+	// Create the snapshot store.  opts.SnapshotStore lets operators ship
+	// snapshots off-box (S3, HTTP-pull); otherwise fall back to local
+	// files, retaining opts.SnapshotRetain of them (default 1).
+	snapshots := opts.SnapshotStore
+	if snapshots == nil {
+		retain := opts.SnapshotRetain
+		if retain <= 0 {
+			retain = 1
+		}
+		snapshots, err = raft.NewFileSnapshotStoreLog(path, retain, lg)
+		if err != nil {
+			store.Close()
+			return nil, nil, err
+		}
 	}
 
 	// Create a transport layer
@@ -133,26 +230,32 @@ func newRaft(peers []string, path string, streams raft.StreamLayer, state raft.F
 	for idx, p := range peers {
 		peerAddrs[idx], err = net.ResolveTCPAddr("tcp", p)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 	}
+	// An empty peer list means we're bootstrapping a brand new cluster --
+	// start up as the sole member and accept joiners later via
+	// JoinCluster/AddPeer rather than requiring the full peer set up front.
+	if len(peerAddrs) == 0 {
+		peerAddrs = []net.Addr{trans.LocalAddr()}
+	}
 	raftPeers := raft.NewJSONPeers(path, trans)
 	if err = raftPeers.SetPeers(peerAddrs); err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	// Ensure local host is always included
 	peerAddrs, err = raftPeers.Peers()
 	if err != nil {
 		store.Close()
-		return nil, err
+		return nil, nil, err
 	}
 	if !raft.PeerContained(peerAddrs, trans.LocalAddr()) {
-		return nil, fmt.Errorf("Localhost %s not included in peers %+v", trans.LocalAddr().String(), peers)
+		return nil, nil, fmt.Errorf("Localhost %s not included in peers %+v", trans.LocalAddr().String(), peers)
 	}
 
 	// Setup the Raft server
 	raftCfg := raft.DefaultConfig()
-	if len(peers) == 1 {
+	if len(peerAddrs) == 1 {
 		raftCfg.EnableSingleNode = true
 	}
 	raft, err := raft.NewRaft(raftCfg, state, store, store,
@@ -160,7 +263,7 @@ func newRaft(peers []string, path string, streams raft.StreamLayer, state raft.F
 	if err != nil {
 		store.Close()
 		trans.Close()
-		return nil, err
+		return nil, nil, err
 	}
 	// wait until we've identified some valid leader
 	timeout := time.Now().Add(1 * time.Minute)
@@ -172,11 +275,11 @@ func newRaft(peers []string, path string, streams raft.StreamLayer, state raft.F
 		} else {
 			time.Sleep(1 * time.Second)
 			if time.Now().After(timeout) {
-				return nil, fmt.Errorf("Timed out with no leader elected after 1 minute!")
+				return nil, nil, fmt.Errorf("Timed out with no leader elected after 1 minute!")
 			}
 		}
 	}
-	return raft, nil
+	return raft, snapshots, nil
 }
 
 func (s *server) serveFollowers() {
@@ -186,26 +289,24 @@ func (s *server) serveFollowers() {
 			s.lg.Printf("ERROR accepting from %s : %s", s.rpcLayer.Addr().String(), err)
 			return
 		}
+		s.metrics.IncCounter("flotilla.rpc.accepted")
 		go serveFollower(s.lg, conn, s)
 	}
 }
 
-// only removes if leader, otherwise returns nil
-func (s *server) RemovePeer(deadPeer net.Addr) error {
-	if s.IsLeader() {
-		return s.raft.RemovePeer(deadPeer).Error()
-	} else {
-		return nil
-	}
-}
-
 // returns addr of leader
 func (s *server) Leader() net.Addr {
+	if s.isProxy {
+		return s.proxyLeader
+	}
 	return s.raft.Leader()
 }
 
 // return if we are leader
 func (s *server) IsLeader() bool {
+	if s.isProxy {
+		return false
+	}
 	return s.raft.State() == raft.Leader
 }
 
@@ -214,24 +315,39 @@ var commandTimeout = 1 * time.Minute
 // public API, executes a command on leader, returns chan which will
 // block until command has been replicated to our local replica
 func (s *server) Command(cmd string, args [][]byte) <-chan Result {
-
+	start := time.Now()
+	var resultCh <-chan Result
 	if s.IsLeader() {
+		s.metrics.IncCounter("command.applied", cmd)
 		cb := s.state.newCommand()
 		cmdBytes := bytesForCommand(cb.originAddr, cb.reqNo, cmd, args)
 		s.raft.Apply(cmdBytes, commandTimeout)
-		return cb.result
-	}
-	// couldn't exec as leader, fallback to forwarding
-	cb, err := s.dispatchToLeader(cmd, args)
-	if err != nil {
-		if cb != nil {
-			cb.cancel()
+		resultCh = cb.result
+	} else {
+		// couldn't exec as leader, fallback to forwarding
+		s.metrics.IncCounter("command.forwarded", cmd)
+		cb, err := s.dispatchToLeader(cmd, args)
+		if err != nil {
+			if cb != nil {
+				cb.cancel()
+			}
+			s.metrics.IncCounter("command.error", cmd)
+			ret := make(chan Result, 1)
+			ret <- Result{nil, err}
+			return ret
 		}
-		ret := make(chan Result, 1)
-		ret <- Result{nil, err}
-		return ret
+		resultCh = cb.result
 	}
-	return cb.result
+	instrumented := make(chan Result, 1)
+	go func() {
+		result := <-resultCh
+		s.metrics.ObserveLatency("command.latency", time.Since(start), cmd)
+		if result.Err != nil {
+			s.metrics.IncCounter("command.error", cmd)
+		}
+		instrumented <- result
+	}()
+	return instrumented
 }
 
 // checks connection state and dispatches the task to leader
@@ -239,28 +355,11 @@ func (s *server) Command(cmd string, args [][]byte) <-chan Result {
 func (s *server) dispatchToLeader(cmd string, args [][]byte) (*commandCallback, error) {
 	s.leaderLock.Lock()
 	defer s.leaderLock.Unlock()
-	var err error
-	if s.leaderConn == nil || s.Leader() == nil || s.Leader().String() != s.leaderConn.remoteAddr().String() {
-		if s.leaderConn != nil {
-			s.lg.Printf("Leader changed, reconnecting, was: %s, now %s", s.leaderConn.remoteAddr(), s.Leader())
-		}
-
-		// reconnect
-		if s.leaderConn != nil {
-			s.leaderConn.c.Close()
-		}
-		newConn, err := s.rpcLayer.Dial(s.Leader().String(), 1*time.Minute)
-		if err != nil {
-			return nil, fmt.Errorf("Couldn't connect to leader at %s", s.Leader().String())
-		}
-		s.leaderConn, err = newConnToLeader(newConn, s.rpcLayer.Addr().String(), s.lg)
-		if err != nil {
-			s.lg.Printf("Got error connecting to leader %s from follower %s : %s", s.Leader().String(), s.rpcLayer.Addr().String(), err)
-			return nil, err
-		}
+	if err := s.ensureLeaderConnLocked(); err != nil {
+		return nil, err
 	}
 	cb := s.state.newCommand()
-	err = s.leaderConn.forwardCommand(cb, cmd, args)
+	err := s.leaderConn.forwardCommand(cb, cmd, args)
 	if err != nil {
 		cb.cancel()
 		return nil, err
@@ -268,6 +367,32 @@ func (s *server) dispatchToLeader(cmd string, args [][]byte) (*commandCallback,
 	return cb, nil
 }
 
+// ensureLeaderConnLocked makes sure s.leaderConn is dialed to the current
+// leader, reconnecting if the leader has changed since the last call.
+// Callers must hold s.leaderLock.
+func (s *server) ensureLeaderConnLocked() error {
+	if s.Leader() == nil {
+		return fmt.Errorf("no leader known for %s", s.rpcLayer.Addr().String())
+	}
+	if s.leaderConn != nil && s.Leader().String() == s.leaderConn.remoteAddr().String() {
+		return nil
+	}
+	if s.leaderConn != nil {
+		s.lg.Printf("Leader changed, reconnecting, was: %s, now %s", s.leaderConn.remoteAddr(), s.Leader())
+		s.leaderConn.c.Close()
+	}
+	newConn, err := s.rpcLayer.Dial(s.Leader().String(), 1*time.Minute)
+	if err != nil {
+		return fmt.Errorf("Couldn't connect to leader at %s", s.Leader().String())
+	}
+	s.leaderConn, err = newConnToLeader(newConn, s.rpcLayer.Addr().String(), s.lg)
+	if err != nil {
+		s.lg.Printf("Got error connecting to leader %s from follower %s : %s", s.Leader().String(), s.rpcLayer.Addr().String(), err)
+		return err
+	}
+	return nil
+}
+
 func (s *server) Read() (*mdb.Txn, error) {
 	return s.state.ReadTxn()
 }
@@ -277,7 +402,22 @@ func (s *server) Rsync() error {
 	result := <-resultCh
 	return result.Err
 }
+
+// Close shuts the server down.  A voting server hands off to raft's own
+// Shutdown(); a proxy has no *raft.Raft to shut down, so instead it stops
+// tailLeader's reconnect loop and closes whatever replication connection
+// tailOnce currently has open (closing it unblocks a tailOnce stuck
+// reading from the leader, same as any other connection failure).
 func (s *server) Close() error {
+	if s.isProxy {
+		s.closeOnce.Do(func() { close(s.closeCh) })
+		s.proxyConnMu.Lock()
+		if s.proxyConn != nil {
+			s.proxyConn.Close()
+		}
+		s.proxyConnMu.Unlock()
+		return nil
+	}
 	f := s.raft.Shutdown()
 	return f.Error()
 }
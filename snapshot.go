@@ -0,0 +1,30 @@
+package flotilla
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// Snapshot forces raft to take a snapshot of the current state immediately,
+// rather than waiting for its usual size-triggered threshold.  Useful
+// before decommissioning a leader or ahead of a planned backup.  The actual
+// EventSnapshotTaken/EventLogCompaction emission happens in
+// flotillaSnapshot.Persist, which also fires for automatic, size-triggered
+// snapshots -- not just this forced one.  A proxy has no *raft.Raft of its
+// own to snapshot (see newProxyServer), so Snapshot returns an error there.
+func (s *server) Snapshot() error {
+	if s.isProxy {
+		return fmt.Errorf("Snapshot isn't supported on proxy nodes")
+	}
+	return s.raft.Snapshot().Error()
+}
+
+// Restore streams a dump of the state machine's MDB (as produced by a
+// backup taken from Snapshot/the snapshot store) into this server,
+// replacing its current data.  Modeled on rqlite's backup/restore over
+// HTTP: an operator can back up a leader and rehydrate a brand new
+// cluster from that dump without copying raft logs.
+func (s *server) Restore(r io.Reader) error {
+	return s.state.Restore(ioutil.NopCloser(r))
+}
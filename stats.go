@@ -0,0 +1,136 @@
+package flotilla
+
+import (
+	"net"
+	"time"
+
+	"github.com/jbooth/raft"
+)
+
+// Metrics is the pluggable instrumentation surface Command(),
+// dispatchToLeader() and serveFollowers() report through.  Plug in a
+// Prometheus or expvar-backed implementation via Options.Metrics; NewDB
+// defaults to a no-op one.
+type Metrics interface {
+	IncCounter(name string, labels ...string)
+	ObserveLatency(name string, d time.Duration, labels ...string)
+}
+
+type noopMetrics struct{}
+
+func (noopMetrics) IncCounter(name string, labels ...string)                      {}
+func (noopMetrics) ObserveLatency(name string, d time.Duration, labels ...string) {}
+
+// EventType enumerates the kinds of cluster-state changes emitted on
+// Events().
+type EventType int
+
+const (
+	EventLeaderChange EventType = iota
+	EventPeerAdded
+	EventPeerRemoved
+	EventSnapshotTaken
+	EventLogCompaction
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventLeaderChange:
+		return "LeaderChange"
+	case EventPeerAdded:
+		return "PeerAdded"
+	case EventPeerRemoved:
+		return "PeerRemoved"
+	case EventSnapshotTaken:
+		return "SnapshotTaken"
+	case EventLogCompaction:
+		return "LogCompaction"
+	default:
+		return "Unknown"
+	}
+}
+
+// Event is a single cluster-state-change notification.
+type Event struct {
+	Type EventType
+	Peer net.Addr // set for LeaderChange/PeerAdded/PeerRemoved
+	At   time.Time
+}
+
+// ClusterStats is a point-in-time snapshot of a server's view of the
+// cluster, returned by Stats().
+type ClusterStats struct {
+	Role         string
+	Leader       net.Addr
+	Peers        []net.Addr
+	LastApplied  uint64
+	CommitIndex  uint64
+	LogSize      uint64
+	LastSnapshot *raft.SnapshotMeta
+
+	// LastApplyLatency is how long the most recently applied command took
+	// to run against the local MDB (see flotillaState.Apply/
+	// ApplyReplicated) -- populated for proxies and voting members alike,
+	// since both apply commands to their local state.
+	LastApplyLatency time.Duration
+}
+
+// Stats returns a snapshot of this node's current role, peers, raft
+// progress and most recent snapshot.  Peers()/raft progress only make
+// sense for voting members: a proxy has no *raft.Raft of its own, so
+// those fields are left at their zero value rather than dereferencing it.
+func (s *server) Stats() ClusterStats {
+	stats := ClusterStats{Leader: s.Leader()}
+	if s.isProxy {
+		stats.Role = "proxy"
+		stats.LastApplied = s.state.AppliedIndex()
+		stats.LastApplyLatency = s.state.LastApplyLatency()
+		return stats
+	}
+	stats.Peers = s.Peers()
+	if s.IsLeader() {
+		stats.Role = "leader"
+	} else {
+		stats.Role = "follower"
+	}
+	stats.LastApplied = s.state.AppliedIndex()
+	stats.LastApplyLatency = s.state.LastApplyLatency()
+	stats.CommitIndex = s.raft.LastIndex()
+	// LogSize is how many entries have accumulated since the last
+	// snapshot compacted the log, not CommitIndex restated: with no
+	// snapshot yet it's the same number, but once a snapshot exists it's
+	// CommitIndex minus that snapshot's index.
+	stats.LogSize = stats.CommitIndex
+	if s.snapshotStore != nil {
+		if metas, err := s.snapshotStore.List(); err == nil && len(metas) > 0 {
+			stats.LastSnapshot = metas[0]
+			stats.LogSize = stats.CommitIndex - metas[0].Index
+		}
+	}
+	return stats
+}
+
+// Events returns a channel of cluster-state-change notifications for as
+// long as this server is running.
+func (s *server) Events() <-chan Event {
+	return s.events
+}
+
+// emit publishes evt on the Events() channel, logging and dropping it
+// rather than blocking the caller if nobody's draining the channel.
+func (s *server) emit(evt Event) {
+	evt.At = time.Now()
+	select {
+	case s.events <- evt:
+	default:
+		s.lg.Printf("WARNING dropping event %s, Events() channel full", evt.Type)
+	}
+}
+
+// watchLeaderChanges relays raft's own leadership-change notifications
+// onto Events() for the life of the server.
+func (s *server) watchLeaderChanges() {
+	for range s.raft.LeaderCh() {
+		s.emit(Event{Type: EventLeaderChange, Peer: s.Leader()})
+	}
+}
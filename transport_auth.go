@@ -0,0 +1,174 @@
+package flotilla
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+const clusterAuthNonceSize = 16
+
+// clusterAuthTimeout bounds how long challengeClusterToken will wait for a
+// connection to complete the HMAC handshake before it's abandoned.
+const clusterAuthTimeout = 10 * time.Second
+
+// tlsListen wraps listen in a TLS listener when cfg is non-nil, leaving it
+// untouched otherwise.
+func tlsListen(listen net.Listener, cfg *tls.Config) net.Listener {
+	if cfg == nil {
+		return listen
+	}
+	return tls.NewListener(listen, cfg)
+}
+
+// tokenDialer wraps base so every outgoing connection is (optionally)
+// TLS-dialed and then proves knowledge of clusterToken, mirroring the
+// challenge authenticateListener issues on accept.  Used for both the raft
+// and flotilla mux legs so neither AppendEntries nor forwarded commands can
+// be injected by a host that doesn't hold the shared token.
+func tokenDialer(base func(string, time.Duration) (net.Conn, error), tlsCfg *tls.Config, clusterToken string) func(string, time.Duration) (net.Conn, error) {
+	return func(addr string, timeout time.Duration) (net.Conn, error) {
+		var conn net.Conn
+		var err error
+		if tlsCfg != nil {
+			conn, err = tls.DialWithDialer(&net.Dialer{Timeout: timeout}, "tcp", addr, tlsCfg)
+		} else {
+			conn, err = base(addr, timeout)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if clusterToken == "" {
+			return conn, nil
+		}
+		if err := proveClusterToken(conn, clusterToken); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+}
+
+// proveClusterToken reads the nonce the accepting side sends, HMACs it
+// with the shared token, and writes the HMAC back.
+func proveClusterToken(conn net.Conn, clusterToken string) error {
+	nonce := make([]byte, clusterAuthNonceSize)
+	if _, err := io.ReadFull(conn, nonce); err != nil {
+		return fmt.Errorf("cluster auth: couldn't read nonce : %s", err)
+	}
+	mac := hmac.New(sha256.New, []byte(clusterToken))
+	mac.Write(nonce)
+	if _, err := conn.Write(mac.Sum(nil)); err != nil {
+		return fmt.Errorf("cluster auth: couldn't write response : %s", err)
+	}
+	return nil
+}
+
+// authListener wraps a net.Listener (raw or TLS), requiring every accepted
+// connection to prove knowledge of clusterToken via HMAC-of-a-nonce before
+// it's handed to the raft/flotilla mux.  Connections that fail the
+// challenge are logged and closed rather than returned, so a bad accept
+// never reaches serveFollowers/raft.
+//
+// The challenge runs in its own goroutine per connection (acceptLoop spawns
+// one per raw accept) rather than inline inside Accept(): a peer that
+// connects and then never writes or reads would otherwise stall Accept()'s
+// single caller forever, blocking every other peer -- including legitimate
+// raft heartbeats and RPC forwards -- from ever being accepted.
+// clusterAuthTimeout bounds each challenge goroutine too, so a stalled peer
+// is eventually abandoned rather than leaking forever.
+type authListener struct {
+	net.Listener
+	clusterToken string
+	lg           *log.Logger
+	accepted     chan net.Conn
+	closed       chan struct{}
+	closeErr     error
+	closeOnce    sync.Once
+}
+
+func authenticateListener(listen net.Listener, clusterToken string, lg *log.Logger) net.Listener {
+	if clusterToken == "" {
+		return listen
+	}
+	l := &authListener{
+		Listener:     listen,
+		clusterToken: clusterToken,
+		lg:           lg,
+		accepted:     make(chan net.Conn),
+		closed:       make(chan struct{}),
+	}
+	go l.acceptLoop()
+	return l
+}
+
+// acceptLoop is the only goroutine that calls the wrapped Listener's
+// Accept(); each connection it gets is handed off to its own challenge
+// goroutine so this loop is never itself blocked on a peer's HMAC response.
+func (l *authListener) acceptLoop() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			l.closeOnce.Do(func() {
+				l.closeErr = err
+				close(l.closed)
+			})
+			return
+		}
+		go l.challenge(conn)
+	}
+}
+
+// challenge runs the HMAC handshake for a single accepted connection,
+// bounded by clusterAuthTimeout so a silent peer gets abandoned instead of
+// leaking the goroutine.  Successfully authenticated connections are
+// handed to Accept() over l.accepted.
+func (l *authListener) challenge(conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(clusterAuthTimeout))
+	err := challengeClusterToken(conn, l.clusterToken)
+	conn.SetDeadline(time.Time{})
+	if err != nil {
+		l.lg.Printf("ERROR rejecting unauthenticated peer %s : %s", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	l.accepted <- conn
+}
+
+func (l *authListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.accepted:
+		return conn, nil
+	case <-l.closed:
+		return nil, l.closeErr
+	}
+}
+
+// challengeClusterToken sends a random nonce and checks the peer returns
+// its HMAC under the shared cluster token.
+func challengeClusterToken(conn net.Conn, clusterToken string) error {
+	nonce := make([]byte, clusterAuthNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	if _, err := conn.Write(nonce); err != nil {
+		return err
+	}
+	expected := hmac.New(sha256.New, []byte(clusterToken))
+	expected.Write(nonce)
+	got := make([]byte, sha256.Size)
+	if _, err := io.ReadFull(conn, got); err != nil {
+		return fmt.Errorf("couldn't read auth response : %s", err)
+	}
+	if !hmac.Equal(got, expected.Sum(nil)) {
+		return fmt.Errorf("invalid cluster token")
+	}
+	return nil
+}
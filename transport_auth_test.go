@@ -0,0 +1,139 @@
+package flotilla
+
+import (
+	"io/ioutil"
+	"log"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestClusterTokenChallengeAccepts(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	errCh := make(chan error, 1)
+	go func() { errCh <- challengeClusterToken(server, "s3cret") }()
+
+	if err := proveClusterToken(client, "s3cret"); err != nil {
+		t.Fatalf("proveClusterToken: %s", err)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatalf("challengeClusterToken rejected a valid token: %s", err)
+	}
+}
+
+func TestClusterTokenChallengeRejectsWrongToken(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	errCh := make(chan error, 1)
+	go func() { errCh <- challengeClusterToken(server, "s3cret") }()
+
+	// proveClusterToken itself can't fail on a bad token -- it just HMACs
+	// whatever it's given -- so the rejection must come from the
+	// challenger comparing against the right one.
+	if err := proveClusterToken(client, "wrong"); err != nil {
+		t.Fatalf("proveClusterToken: %s", err)
+	}
+	if err := <-errCh; err == nil {
+		t.Fatal("expected challengeClusterToken to reject a mismatched token")
+	}
+}
+
+func TestAuthListenerStalledConnDoesntBlockOthers(t *testing.T) {
+	raw, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %s", err)
+	}
+	defer raw.Close()
+	listen := authenticateListener(raw, "s3cret", log.New(ioutil.Discard, "", 0))
+
+	// A client that connects and then never writes or reads must not be
+	// able to stall Accept()'s single caller: the challenge for this
+	// connection has to run off on its own, not inline in Accept().
+	stalled, err := net.Dial("tcp", raw.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %s", err)
+	}
+	defer stalled.Close()
+
+	good, err := net.Dial("tcp", raw.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %s", err)
+	}
+	defer good.Close()
+	if err := proveClusterToken(good, "s3cret"); err != nil {
+		t.Fatalf("proveClusterToken: %s", err)
+	}
+
+	accepted := make(chan net.Conn, 1)
+	acceptErr := make(chan error, 1)
+	go func() {
+		conn, err := listen.Accept()
+		if err != nil {
+			acceptErr <- err
+			return
+		}
+		accepted <- conn
+	}()
+
+	select {
+	case conn := <-accepted:
+		conn.Close()
+	case err := <-acceptErr:
+		t.Fatalf("Accept() returned an error: %s", err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("Accept() never returned the good connection; a stalled peer blocked the accept loop")
+	}
+}
+
+func TestAuthListenerDropsUnauthenticatedConns(t *testing.T) {
+	raw, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %s", err)
+	}
+	defer raw.Close()
+	listen := authenticateListener(raw, "s3cret", log.New(ioutil.Discard, "", 0))
+
+	accepted := make(chan net.Conn, 1)
+	acceptErr := make(chan error, 1)
+	go func() {
+		conn, err := listen.Accept()
+		if err != nil {
+			acceptErr <- err
+			return
+		}
+		accepted <- conn
+	}()
+
+	bad, err := net.Dial("tcp", raw.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %s", err)
+	}
+	if err := proveClusterToken(bad, "wrong"); err != nil {
+		t.Fatalf("proveClusterToken: %s", err)
+	}
+	bad.Close()
+
+	good, err := net.Dial("tcp", raw.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %s", err)
+	}
+	defer good.Close()
+	if err := proveClusterToken(good, "s3cret"); err != nil {
+		t.Fatalf("proveClusterToken: %s", err)
+	}
+
+	select {
+	case conn := <-accepted:
+		defer conn.Close()
+		if conn.RemoteAddr().String() != good.LocalAddr().String() {
+			t.Fatalf("Accept() returned %s, want the authenticated conn from %s", conn.RemoteAddr(), good.LocalAddr())
+		}
+	case err := <-acceptErr:
+		t.Fatalf("Accept() returned an error: %s", err)
+	}
+}